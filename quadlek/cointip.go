@@ -2,25 +2,36 @@ package cointip
 
 import (
 	"context"
-	"sync"
+	"time"
 
 	"strings"
 
 	"fmt"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
 	"github.com/jirwin/quadlek/quadlek"
 	"github.com/morgabra/cointip"
 )
 
 var coinbaseClient *cointip.ApiKeyClient
-var bankAccount *cointip.Account
-var accountsCache []*cointip.Account
-var accountsCacheLock = &sync.Mutex{}
+
+var dataStore Store
+var withdrawals withdrawalStore
+var reserves *reserveManager
+var pluginCtx context.Context
+var pluginCancel context.CancelFunc
+
+const historyLimit = 20
+const leaderboardLimit = 10
 
 func help(cmdMsg *quadlek.CommandMsg) {
 	cmdMsg.Command.Reply() <- &quadlek.CommandResp{
-		Text:      "cointip: Tip your friends!\nAvailable commands: help, balance, deposit, withdraw",
+		Text: "cointip: Tip your friends!\n" +
+			"Available commands: help, balance, deposit, withdraw, withdrawals, history, leaderboard, export, import\n" +
+			"note: export/import don't move funds off or back onto Coinbase yet - there's no real on-chain key or " +
+			"address support behind them. export just hands you an encrypted keystore for safekeeping, and import " +
+			"hands you a deposit address, same as deposit.",
 		InChannel: false,
 	}
 }
@@ -47,53 +58,78 @@ func accountBalanceString(account *cointip.Account) string {
 	)
 }
 
-func getOrCreateAccount(userId string, refresh bool) (*cointip.Account, error) {
-
-	acctId := fmt.Sprintf("cointip_%s", userId)
-
-	accountsCacheLock.Lock()
-	defer accountsCacheLock.Unlock()
+// getOrCreateAccount resolves a user's Coinbase account id for currency,
+// creating and priming one on first use. For an account that already exists
+// it does not round-trip to Coinbase: every caller that cares about the
+// account's actual balance (export, the balance command) fetches it live
+// itself, and withReserve does its own live fetch before it trusts a
+// balance for a spend, so returning just the id here is enough for the
+// common case of tipping and withdrawing.
+func getOrCreateAccount(userId string, currency cointip.Currency) (*cointip.Account, error) {
 
-	// Warm the cache
-	if len(accountsCache) == 0 {
-		accts, err := coinbaseClient.ListAccounts()
-		if err != nil {
-			return nil, err
-		}
-		accountsCache = accts
+	acctId, found, err := dataStore.GetAccountId(userId, currency)
+	if err != nil {
+		return nil, err
 	}
 
-	for i, account := range accountsCache {
-		// If we find an account in the cache, we optionally refresh it and return it
-		if account.ID == acctId {
-			if refresh {
-				account, err := coinbaseClient.GetAccount(account.ID)
-				if err != nil {
-					return nil, err
-				}
-				accountsCache[i] = account
-			}
-			return account, nil
-		}
+	if found {
+		return &cointip.Account{ID: acctId}, nil
 	}
 
-	// Otherwise, create and cache it
+	acctId = fmt.Sprintf("cointip_%s_%s", userId, currency)
 	account, err := coinbaseClient.CreateAccount(acctId)
 	if err != nil {
 		return nil, err
 	}
-	accountsCache = append(accountsCache, account)
+
+	if err := dataStore.SetAccountId(userId, currency, acctId); err != nil {
+		log.WithError(err).Error("Failed to persist account mapping.")
+	}
 	log.Infof("Created new cointip account: %s", acctId)
 
-	tx, err := coinbaseClient.Transfer(bankAccount.ID, account.ID, &cointip.Balance{Currency: cointip.CurrencyUSD, Amount: 3.00})
+	primeAccount(account, currency)
+
+	return account, nil
+}
+
+// primeAccount transfers a small starting balance into a freshly created
+// account from the bank account for its currency. The account is marked as
+// primed in the store before the transfer is attempted, so a crash between
+// the transfer succeeding and the mark being written can't result in the
+// same account being primed twice on the next restart.
+func primeAccount(account *cointip.Account, currency cointip.Currency) {
+	primed, err := dataStore.IsPrimed(account.ID)
 	if err != nil {
-		log.WithError(err).Errorf("Failed to prime new cointip account from bank: %s", bankAccount.ID)
-		// non-fatal, so we still return the account
-	} else {
-		log.Infof("Primed new cointip account %s txid: %s", acctId, tx.ID)
+		log.WithError(err).Errorf("Failed to check priming state for %s, skipping priming.", account.ID)
+		return
+	}
+	if primed {
+		return
 	}
 
-	return account, nil
+	bank, ok := bankAccounts[currency]
+	if !ok {
+		log.Warnf("No bank account configured for currency %s, skipping priming for %s", currency, account.ID)
+		return
+	}
+
+	amount, ok := primingAmounts[currency]
+	if !ok {
+		amount = defaultPrimingAmount
+	}
+
+	if err := dataStore.SetPrimed(account.ID); err != nil {
+		log.WithError(err).Errorf("Failed to persist priming state for %s, skipping priming to avoid a double-prime on retry.", account.ID)
+		return
+	}
+
+	tx, err := coinbaseClient.Transfer(bank.ID, account.ID, &cointip.Balance{Currency: currency, Amount: amount})
+	if err != nil {
+		log.WithError(err).Errorf("Failed to prime new cointip account from bank: %s", bank.ID)
+		// non-fatal, so getOrCreateAccount still returns the account
+		return
+	}
+	log.Infof("Primed new cointip account %s txid: %s", account.ID, tx.ID)
 }
 
 func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.ReactionHookMsg) {
@@ -101,36 +137,26 @@ func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.Reacti
 		select {
 		case rh := <-reactionChannel:
 
-			amount := &cointip.Balance{
-				Currency: cointip.CurrencyUSD,
-			}
-			switch rh.Reaction.Reaction {
-			case ":cointip_1:":
-				amount.Amount = .01
-			case ":cointip_2:":
-				amount.Amount = .02
-			case ":cointip_5:":
-				amount.Amount = .05
-			case ":cointip_10:":
-				amount.Amount = .10
-			case ":cointip_25:":
-				amount.Amount = .25
-			default:
+			tip, ok := reactionTips[rh.Reaction.Reaction]
+			if !ok {
 				return
 			}
+			amount := &cointip.Balance{Currency: tip.Currency, Amount: tip.Amount}
 
-			from, err := getOrCreateAccount(rh.Reaction.User, false)
+			from, err := getOrCreateAccount(rh.Reaction.User, tip.Currency)
 			if err != nil {
 				log.WithError(err).Error("Failed fetching coinbase account.")
 				return
 			}
-			to, err := getOrCreateAccount(rh.Reaction.ItemUser, false)
+			to, err := getOrCreateAccount(rh.Reaction.ItemUser, tip.Currency)
 			if err != nil {
 				log.WithError(err).Error("Failed fetching coinbase account.")
 				return
 			}
 
-			tx, err := coinbaseClient.Transfer(from.ID, to.ID, amount)
+			tx, err := reserves.withReserve(from, amount.Amount, func() (*cointip.Transaction, error) {
+				return coinbaseClient.Transfer(from.ID, to.ID, amount)
+			})
 			if err != nil {
 				log.WithError(err).Error("Failed creating transaction.")
 				return
@@ -138,6 +164,20 @@ func cointipReaction(ctx context.Context, reactionChannel <-chan *quadlek.Reacti
 
 			log.Infof("%s tipped %s %s:%.2f txid: %s", from.ID, to.ID, tx.NativeAmount.Currency, tx.NativeAmount.Amount, tx.ID)
 
+			ledgerErr := dataStore.RecordLedger(&LedgerEntry{
+				Kind:         LedgerKindTip,
+				FromUser:     rh.Reaction.User,
+				ToUser:       rh.Reaction.ItemUser,
+				Reaction:     rh.Reaction.Reaction,
+				CoinbaseTxId: tx.ID,
+				NativeAmount: tx.NativeAmount,
+				Status:       "completed",
+				CreatedAt:    time.Now(),
+			})
+			if ledgerErr != nil {
+				log.WithError(ledgerErr).Error("Failed to record tip in ledger.")
+			}
+
 		case <-ctx.Done():
 			return
 		}
@@ -150,23 +190,32 @@ func cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg)
 		case cmdMsg := <-cmdChannel:
 
 			// /cointip <command> <args...>
-			cmd := strings.SplitN(cmdMsg.Command.Text, " ", 1)
+			cmd := strings.Fields(cmdMsg.Command.Text)
 			if len(cmd) == 0 {
 				help(cmdMsg)
 				return
 			}
+			args := cmd[1:]
 
 			switch cmd[0] {
 			case "balance":
-				account, err := getOrCreateAccount(cmdMsg.Command.UserId, true)
+				accounts, err := userAccounts(cmdMsg.Command.UserId)
 				if err != nil {
-					log.WithError(err).Error("Failed fetching coinbase account.")
+					log.WithError(err).Error("Failed fetching coinbase accounts.")
 					sayError(cmdMsg, err.Error(), false)
 					return
 				}
-				say(cmdMsg, fmt.Sprintf("tipjar balance: %s", accountBalanceString(account)), false)
+				if len(accounts) == 0 {
+					say(cmdMsg, "you don't have a tipjar balance yet", false)
+					return
+				}
+				lines := make([]string, 0, len(accounts))
+				for _, account := range accounts {
+					lines = append(lines, accountBalanceString(account))
+				}
+				say(cmdMsg, fmt.Sprintf("tipjar balance:\n%s", strings.Join(lines, "\n")), false)
 			case "deposit":
-				account, err := getOrCreateAccount(cmdMsg.Command.UserId, false)
+				account, err := getOrCreateAccount(cmdMsg.Command.UserId, cointip.CurrencyUSD)
 				if err != nil {
 					log.WithError(err).Error("Failed fetching coinbase account.")
 					sayError(cmdMsg, err.Error(), false)
@@ -180,7 +229,17 @@ func cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg)
 				}
 				say(cmdMsg, fmt.Sprintf("deposit address: %s", address), false)
 			case "withdraw":
-				say(cmdMsg, "withdraw is not implemented yet, sorry!", false)
+				doWithdraw(cmdMsg, args)
+			case "withdrawals":
+				doWithdrawals(cmdMsg)
+			case "history":
+				doHistory(cmdMsg, args)
+			case "leaderboard":
+				doLeaderboard(cmdMsg)
+			case "export":
+				doExport(cmdMsg, args)
+			case "import":
+				doImport(cmdMsg, strings.TrimSpace(strings.TrimPrefix(cmdMsg.Command.Text, cmd[0])))
 			default:
 				help(cmdMsg)
 				return
@@ -192,19 +251,58 @@ func cointipCommand(ctx context.Context, cmdChannel <-chan *quadlek.CommandMsg)
 	}
 }
 
-func Register(apiKey, apiSecret, bankAccountId string) quadlek.Plugin {
+func Register(apiKey, apiSecret string, bankAccountIds map[cointip.Currency]string, tips map[string]*ReactionTip, dbPath string) quadlek.Plugin {
 	client, err := cointip.APIKeyClient(apiKey, apiSecret)
 	if err != nil {
 		return nil
 	}
 	coinbaseClient = client
 
-	// Warm the cache and fetch the bank account
-	account, err := getOrCreateAccount(bankAccountId, true)
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
+		log.WithError(err).Error("Failed to open cointip database.")
 		return nil
 	}
-	bankAccount = account
+
+	ds, err := openStore(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to open cointip store.")
+		return nil
+	}
+	dataStore = ds
+
+	// Fetch (or create) the bank account for each configured currency. A newly
+	// created bank account is not primed: no bank account for its currency is
+	// registered yet when primeAccount runs.
+	for currency, acctId := range bankAccountIds {
+		account, err := getOrCreateAccount(acctId, currency)
+		if err != nil {
+			return nil
+		}
+		bankAccounts[currency] = account
+	}
+
+	if len(tips) == 0 {
+		tips = defaultReactionTips
+	}
+	reactionTips = tips
+
+	store, err := openWithdrawalStore(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to open withdrawal store.")
+		return nil
+	}
+	withdrawals = store
+
+	rm, err := newReserveManager(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to open reserve manager.")
+		return nil
+	}
+	reserves = rm
+
+	pluginCtx, pluginCancel = context.WithCancel(context.Background())
+	reconcileWithdrawals(pluginCtx)
 
 	return quadlek.MakePlugin(
 		"cointip",
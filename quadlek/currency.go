@@ -0,0 +1,50 @@
+package cointip
+
+import (
+	"github.com/morgabra/cointip"
+)
+
+// ReactionTip maps a single emoji reaction to the currency and amount it tips.
+type ReactionTip struct {
+	Currency cointip.Currency
+	Amount   float64
+}
+
+// defaultReactionTips preserves the original hardcoded USD-only reactions for
+// operators who don't configure their own table.
+var defaultReactionTips = map[string]*ReactionTip{
+	":cointip_1:":  {Currency: cointip.CurrencyUSD, Amount: .01},
+	":cointip_2:":  {Currency: cointip.CurrencyUSD, Amount: .02},
+	":cointip_5:":  {Currency: cointip.CurrencyUSD, Amount: .05},
+	":cointip_10:": {Currency: cointip.CurrencyUSD, Amount: .10},
+	":cointip_25:": {Currency: cointip.CurrencyUSD, Amount: .25},
+}
+
+// defaultPrimingAmount is used for any currency an operator configures a bank
+// account for but doesn't give an explicit priming amount.
+const defaultPrimingAmount = 0.01
+
+var reactionTips map[string]*ReactionTip
+var bankAccounts = map[cointip.Currency]*cointip.Account{}
+var primingAmounts = map[cointip.Currency]float64{
+	cointip.CurrencyUSD: 3.00,
+}
+
+// userAccounts returns every account on record for userId, one per currency
+// they have an account in, without creating any new ones.
+func userAccounts(userId string) ([]*cointip.Account, error) {
+	refs, err := dataStore.AccountsForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]*cointip.Account, 0, len(refs))
+	for _, ref := range refs {
+		account, err := coinbaseClient.GetAccount(ref.AcctId)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
@@ -0,0 +1,77 @@
+package cointip
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jirwin/quadlek/quadlek"
+)
+
+var slackMentionRe = regexp.MustCompile(`^<@([A-Za-z0-9]+)(\|[^>]*)?>$`)
+
+func ledgerEntryString(e *LedgerEntry) string {
+	ts := e.CreatedAt.Format(time.RFC822)
+	switch e.Kind {
+	case LedgerKindTip:
+		return fmt.Sprintf("%s: %s tipped %s %s:%.2f %s [%s]", ts, e.FromUser, e.ToUser, e.NativeAmount.Currency, e.NativeAmount.Amount, e.Reaction, e.Status)
+	case LedgerKindWithdrawal:
+		return fmt.Sprintf("%s: %s withdrew %s:%.2f [%s]", ts, e.FromUser, e.NativeAmount.Currency, e.NativeAmount.Amount, e.Status)
+	case LedgerKindImport:
+		return fmt.Sprintf("%s: %s imported a wallet [%s]", ts, e.ToUser, e.Status)
+	case LedgerKindExport:
+		return fmt.Sprintf("%s: %s exported a keystore [%s]", ts, e.FromUser, e.Status)
+	default:
+		return fmt.Sprintf("%s: unknown ledger entry", ts)
+	}
+}
+
+func doHistory(cmdMsg *quadlek.CommandMsg, args []string) {
+	userId := cmdMsg.Command.UserId
+	if len(args) > 0 {
+		match := slackMentionRe.FindStringSubmatch(args[0])
+		if match == nil {
+			say(cmdMsg, "usage: /cointip history [@user]", false)
+			return
+		}
+		userId = match[1]
+	}
+
+	entries, err := dataStore.History(userId, historyLimit)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching history.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(entries) == 0 {
+		say(cmdMsg, "no history on record", false)
+		return
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, ledgerEntryString(e))
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
+
+func doLeaderboard(cmdMsg *quadlek.CommandMsg) {
+	board, err := dataStore.Leaderboard(leaderboardLimit)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching leaderboard.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(board) == 0 {
+		say(cmdMsg, "no tips on record yet", false)
+		return
+	}
+
+	lines := make([]string, 0, len(board))
+	for i, entry := range board {
+		lines = append(lines, fmt.Sprintf("%d. <@%s>: %d tips", i+1, entry.UserId, entry.Count))
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}
@@ -0,0 +1,133 @@
+package cointip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/morgabra/cointip"
+)
+
+var reserveJournalBucket = []byte("reserve_journal")
+
+type reserveEvent struct {
+	AcctId string    `json:"acct_id"`
+	Action string    `json:"action"`
+	Amount float64   `json:"amount"`
+	At     time.Time `json:"at"`
+}
+
+// reserveManager tracks, per account, how much of the account's balance has been
+// earmarked for an in-flight Coinbase call but not yet confirmed. Without it,
+// two transfers issued back to back against the same cached account can both
+// see the same pre-spend balance and together overdraw it before Coinbase
+// catches up.
+type reserveManager struct {
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex
+	reserved map[string]float64
+	journal  *bolt.DB
+}
+
+func newReserveManager(db *bolt.DB) (*reserveManager, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(reserveJournalBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &reserveManager{
+		locks:    make(map[string]*sync.Mutex),
+		reserved: make(map[string]float64),
+		journal:  db,
+	}, nil
+}
+
+func (r *reserveManager) lockFor(acctId string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.locks[acctId]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[acctId] = l
+	}
+	return l
+}
+
+func (r *reserveManager) journalEvent(acctId, action string, amount float64) {
+	err := r.journal.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(&reserveEvent{AcctId: acctId, Action: action, Amount: amount, At: time.Now()})
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(reserveJournalBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, buf)
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to journal reserve event.")
+	}
+}
+
+// withReserve earmarks amount against account, runs fn, and unwinds the
+// reservation once fn settles. reserve/commit/release for a given account
+// are serialized by a keyed lock so concurrent calls against the same
+// account see an accurate spendable balance instead of racing on the same
+// cached snapshot.
+//
+// Only the caller's account.ID is used, to pick the right lock; its
+// NativeBalance is never trusted for the insufficient-balance check, because it was read
+// before this call took the lock and a prior commit against the same
+// account can have already moved it. Instead, once inside the lock, this
+// re-fetches the account live from Coinbase, which already reflects every
+// previously committed spend. r.reserved only has to cover the window this
+// one call is in flight, so it's released on both success and failure -
+// holding it past fn returning would double-count a spend the live balance
+// already accounts for.
+func (r *reserveManager) withReserve(account *cointip.Account, amount float64, fn func() (*cointip.Transaction, error)) (*cointip.Transaction, error) {
+	l := r.lockFor(account.ID)
+	l.Lock()
+	defer l.Unlock()
+
+	fresh, err := coinbaseClient.GetAccount(account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	available := fresh.NativeBalance.Amount - r.reserved[account.ID]
+	if available < amount {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("insufficient spendable balance: have %.2f, need %.2f", available, amount)
+	}
+	r.reserved[account.ID] += amount
+	r.mu.Unlock()
+	r.journalEvent(account.ID, "reserve", amount)
+
+	tx, err := fn()
+
+	r.mu.Lock()
+	r.reserved[account.ID] -= amount
+	r.mu.Unlock()
+
+	if err != nil {
+		r.journalEvent(account.ID, "release", amount)
+		return nil, err
+	}
+
+	r.journalEvent(account.ID, "commit", amount)
+
+	return tx, nil
+}
@@ -0,0 +1,222 @@
+package cointip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/morgabra/cointip"
+)
+
+var accountsBucket = []byte("accounts")
+var primedBucket = []byte("primed")
+var ledgerBucket = []byte("ledger")
+
+// AccountRef is a user's account id for a single currency.
+type AccountRef struct {
+	Currency cointip.Currency `json:"currency"`
+	AcctId   string           `json:"acct_id"`
+}
+
+type LedgerKind string
+
+const (
+	LedgerKindTip        LedgerKind = "tip"
+	LedgerKindWithdrawal LedgerKind = "withdrawal"
+	LedgerKindImport     LedgerKind = "import"
+	LedgerKindExport     LedgerKind = "export"
+)
+
+// LedgerEntry is a single normalized record of a tip, withdrawal, import or export, kept
+// around as the audit trail the plugin otherwise only had as log lines.
+type LedgerEntry struct {
+	Kind         LedgerKind       `json:"kind"`
+	FromUser     string           `json:"from_user"`
+	ToUser       string           `json:"to_user"`
+	Reaction     string           `json:"reaction"`
+	CoinbaseTxId string           `json:"coinbase_tx_id"`
+	NativeAmount *cointip.Balance `json:"native_amount"`
+	Status       string           `json:"status"`
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+// LeaderboardEntry ranks a user by how many tips they've received.
+type LeaderboardEntry struct {
+	UserId string
+	Count  int
+}
+
+// Store persists everything that used to live only in process memory: the
+// user->account mapping, whether an account has already been primed from the
+// bank, and the ledger of every tip and withdrawal.
+//
+// Only a bolt-backed implementation (boltStore) exists. The plugin already
+// opens a bolt.DB for withdrawals and the reserve journal, so a sqlite
+// implementation was left out rather than added as a second, unused backend
+// with no operator asking for it.
+type Store interface {
+	GetAccountId(userId string, currency cointip.Currency) (acctId string, found bool, err error)
+	SetAccountId(userId string, currency cointip.Currency, acctId string) error
+	AccountsForUser(userId string) ([]*AccountRef, error)
+
+	IsPrimed(acctId string) (bool, error)
+	SetPrimed(acctId string) error
+
+	RecordLedger(entry *LedgerEntry) error
+	History(userId string, limit int) ([]*LedgerEntry, error)
+	Leaderboard(limit int) ([]*LeaderboardEntry, error)
+}
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openStore(db *bolt.DB) (Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{accountsBucket, primedBucket, ledgerBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func accountKey(userId string, currency cointip.Currency) []byte {
+	return []byte(fmt.Sprintf("%s:%s", userId, currency))
+}
+
+func (s *boltStore) GetAccountId(userId string, currency cointip.Currency) (string, bool, error) {
+	var acctId string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(accountsBucket).Get(accountKey(userId, currency))
+		if v != nil {
+			acctId = string(v)
+		}
+		return nil
+	})
+	return acctId, acctId != "", err
+}
+
+func (s *boltStore) SetAccountId(userId string, currency cointip.Currency, acctId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).Put(accountKey(userId, currency), []byte(acctId))
+	})
+}
+
+func (s *boltStore) AccountsForUser(userId string) ([]*AccountRef, error) {
+	prefix := []byte(fmt.Sprintf("%s:", userId))
+	var refs []*AccountRef
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(accountsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			refs = append(refs, &AccountRef{
+				Currency: cointip.Currency(bytes.TrimPrefix(k, prefix)),
+				AcctId:   string(v),
+			})
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (s *boltStore) IsPrimed(acctId string) (bool, error) {
+	var primed bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		primed = tx.Bucket(primedBucket).Get([]byte(acctId)) != nil
+		return nil
+	})
+	return primed, err
+}
+
+func (s *boltStore) SetPrimed(acctId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(primedBucket).Put([]byte(acctId), []byte{1})
+	})
+}
+
+func (s *boltStore) RecordLedger(entry *LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ledgerBucket)
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, buf)
+	})
+}
+
+func (s *boltStore) allLedgerEntries() ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).ForEach(func(k, v []byte) error {
+			e := &LedgerEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *boltStore) History(userId string, limit int) ([]*LedgerEntry, error) {
+	entries, err := s.allLedgerEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var mine []*LedgerEntry
+	for _, e := range entries {
+		if e.FromUser == userId || e.ToUser == userId {
+			mine = append(mine, e)
+		}
+	}
+
+	sort.Slice(mine, func(i, j int) bool { return mine[i].CreatedAt.After(mine[j].CreatedAt) })
+	if len(mine) > limit {
+		mine = mine[:limit]
+	}
+	return mine, nil
+}
+
+func (s *boltStore) Leaderboard(limit int) ([]*LeaderboardEntry, error) {
+	entries, err := s.allLedgerEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, e := range entries {
+		if e.Kind != LedgerKindTip {
+			continue
+		}
+		counts[e.ToUser]++
+	}
+
+	board := make([]*LeaderboardEntry, 0, len(counts))
+	for userId, count := range counts {
+		board = append(board, &LeaderboardEntry{UserId: userId, Count: count})
+	}
+	sort.Slice(board, func(i, j int) bool { return board[i].Count > board[j].Count })
+	if len(board) > limit {
+		board = board[:limit]
+	}
+	return board, nil
+}
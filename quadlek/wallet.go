@@ -0,0 +1,298 @@
+package cointip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 3
+	scryptN         = 1 << 18
+	scryptR         = 8
+	scryptP         = 1
+	scryptDKLen     = 32
+)
+
+type keystoreCipherParams struct {
+	IV string `json:"iv"`
+}
+
+type keystoreKDFParams struct {
+	DKLen int    `json:"dklen"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  string `json:"salt"`
+}
+
+type keystoreCrypto struct {
+	Cipher       string               `json:"cipher"`
+	CipherText   string               `json:"ciphertext"`
+	CipherParams keystoreCipherParams `json:"cipherparams"`
+	KDF          string               `json:"kdf"`
+	KDFParams    keystoreKDFParams    `json:"kdfparams"`
+	MAC          string               `json:"mac"`
+}
+
+// keystoreJSON is a JSON keystore v3 layout (scrypt + AES-CTR), the same
+// shape wallets like geth use, so an exported file can be stored and
+// inspected independently of this plugin.
+type keystoreJSON struct {
+	Address string         `json:"address"`
+	Crypto  keystoreCrypto `json:"crypto"`
+	Id      string         `json:"id"`
+	Version int            `json:"version"`
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// keyAddress derives a stable identifier for a key. It isn't a real on-chain
+// address format for any particular currency; it's only used so an exported
+// keystore carries something to identify itself by.
+func keyAddress(key *ecdsa.PrivateKey) string {
+	pub := elliptic.Marshal(key.PublicKey.Curve, key.PublicKey.X, key.PublicKey.Y)
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[12:])
+}
+
+func encryptKey(key *ecdsa.PrivateKey, passphrase string) (*keystoreJSON, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	derivedKey, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptDKLen)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(derivedKey[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	plainKey := key.D.Bytes()
+	cipherText := make([]byte, len(plainKey))
+	cipher.NewCTR(block, iv).XORKeyStream(cipherText, plainKey)
+
+	mac := sha256.Sum256(append(derivedKey[16:32], cipherText...))
+
+	return &keystoreJSON{
+		Address: keyAddress(key),
+		Crypto: keystoreCrypto{
+			Cipher:       "aes-128-ctr",
+			CipherText:   hex.EncodeToString(cipherText),
+			CipherParams: keystoreCipherParams{IV: hex.EncodeToString(iv)},
+			KDF:          "scrypt",
+			KDFParams: keystoreKDFParams{
+				DKLen: scryptDKLen,
+				N:     scryptN,
+				R:     scryptR,
+				P:     scryptP,
+				Salt:  hex.EncodeToString(salt),
+			},
+			MAC: hex.EncodeToString(mac[:]),
+		},
+		Id:      randomUUID(),
+		Version: keystoreVersion,
+	}, nil
+}
+
+func decryptKey(ks *keystoreJSON, passphrase string) (*ecdsa.PrivateKey, error) {
+	if ks.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version: %d", ks.Version)
+	}
+	if ks.Crypto.Cipher != "aes-128-ctr" || ks.Crypto.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported keystore cipher/kdf")
+	}
+
+	salt, err := hex.DecodeString(ks.Crypto.KDFParams.Salt)
+	if err != nil {
+		return nil, err
+	}
+	derivedKey, err := scrypt.Key([]byte(passphrase), salt, ks.Crypto.KDFParams.N, ks.Crypto.KDFParams.R, ks.Crypto.KDFParams.P, ks.Crypto.KDFParams.DKLen)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherText, err := hex.DecodeString(ks.Crypto.CipherText)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := sha256.Sum256(append(derivedKey[16:32], cipherText...))
+	if hex.EncodeToString(mac[:]) != ks.Crypto.MAC {
+		return nil, fmt.Errorf("could not decrypt key, bad passphrase or corrupt keystore")
+	}
+
+	iv, err := hex.DecodeString(ks.Crypto.CipherParams.IV)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derivedKey[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	plainKey := make([]byte, len(cipherText))
+	cipher.NewCTR(block, iv).XORKeyStream(plainKey, cipherText)
+
+	curve := elliptic.P256()
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = curve
+	priv.D = new(big.Int).SetBytes(plainKey)
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(plainKey)
+
+	return priv, nil
+}
+
+// doExport generates and encrypts a brand new key and hands it back to the
+// user as a keystore file. This is informational only: the plugin has no
+// secp256k1 key support or real chain address derivation for any currency
+// it handles, so there's no address it could hand Coinbase that the
+// recovered key would actually control on-chain. It does NOT call
+// coinbaseClient.SendMoney or touch the user's balance - that balance stays
+// exactly where it is, on Coinbase, until real on-chain custody support
+// exists.
+func doExport(cmdMsg *quadlek.CommandMsg, args []string) {
+	if len(args) != 2 {
+		say(cmdMsg, "usage: /cointip export <currency> <passphrase>", false)
+		return
+	}
+
+	currency := cointip.Currency(strings.ToUpper(args[0]))
+	passphrase := args[1]
+
+	account, err := getOrCreateAccount(cmdMsg.Command.UserId, currency)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	account, err = coinbaseClient.GetAccount(account.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.WithError(err).Error("Failed generating export key.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	ks, err := encryptKey(key, passphrase)
+	if err != nil {
+		log.WithError(err).Error("Failed encrypting export key.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	blob, err := json.Marshal(ks)
+	if err != nil {
+		log.WithError(err).Error("Failed encoding keystore.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	ledgerErr := dataStore.RecordLedger(&LedgerEntry{
+		Kind:      LedgerKindExport,
+		FromUser:  cmdMsg.Command.UserId,
+		Status:    "informational",
+		CreatedAt: time.Now(),
+	})
+	if ledgerErr != nil {
+		log.WithError(ledgerErr).Error("Failed to record export in ledger.")
+	}
+
+	say(cmdMsg, fmt.Sprintf(
+		"this keystore is informational only - it does NOT move your %s balance off Coinbase. "+
+			"your tipjar balance is unchanged (%s). this plugin can't yet generate or hold a real "+
+			"on-chain %s key, so there's nothing to actually self-custody until that lands.\n"+
+			"save this somewhere safe, it will not be shown again:\n```%s```",
+		currency, accountBalanceString(account), currency, string(blob),
+	), false)
+}
+
+// doImport decrypts a keystore and hands the user a fresh deposit address
+// for the currency named in the command. It can't itself sign and broadcast an
+// on-chain sweep from the recovered key back to Coinbase - this plugin has
+// no chain node to do that with - so the user still has to move the funds
+// to the returned address themselves; Coinbase credits the sub-account once
+// it sees the deposit land, same as /cointip deposit.
+func doImport(cmdMsg *quadlek.CommandMsg, rest string) {
+	parts := strings.SplitN(rest, " ", 3)
+	if len(parts) != 3 {
+		say(cmdMsg, "usage: /cointip import <currency> <passphrase> <keystore json>", false)
+		return
+	}
+
+	currency := cointip.Currency(strings.ToUpper(parts[0]))
+	passphrase := parts[1]
+	keystoreText := parts[2]
+
+	ks := &keystoreJSON{}
+	if err := json.Unmarshal([]byte(keystoreText), ks); err != nil {
+		sayError(cmdMsg, fmt.Sprintf("couldn't parse keystore: %s", err.Error()), false)
+		return
+	}
+
+	if _, err := decryptKey(ks, passphrase); err != nil {
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	account, err := getOrCreateAccount(cmdMsg.Command.UserId, currency)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	address, err := coinbaseClient.CreateAddress(account.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase address.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	ledgerErr := dataStore.RecordLedger(&LedgerEntry{
+		Kind:      LedgerKindImport,
+		ToUser:    cmdMsg.Command.UserId,
+		Status:    "awaiting_deposit",
+		CreatedAt: time.Now(),
+	})
+	if ledgerErr != nil {
+		log.WithError(ledgerErr).Error("Failed to record import in ledger.")
+	}
+
+	say(cmdMsg, fmt.Sprintf("keystore decrypted. send your %s balance to %s to credit it back to your tipjar", currency, address), false)
+}
@@ -0,0 +1,260 @@
+package cointip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/jirwin/quadlek/quadlek"
+	"github.com/morgabra/cointip"
+)
+
+// WithdrawalStatus mirrors the lifecycle of a Coinbase send: it starts out
+// pending/created and eventually lands on a terminal completed/failed state.
+type WithdrawalStatus string
+
+const (
+	WithdrawalPending   WithdrawalStatus = "pending"
+	WithdrawalCreated   WithdrawalStatus = "created"
+	WithdrawalCompleted WithdrawalStatus = "completed"
+	WithdrawalFailed    WithdrawalStatus = "failed"
+)
+
+func (s WithdrawalStatus) terminal() bool {
+	return s == WithdrawalCompleted || s == WithdrawalFailed
+}
+
+var withdrawalsBucket = []byte("withdrawals")
+
+// Withdrawal records a single outbound send so it can be reconciled across restarts.
+type Withdrawal struct {
+	UserId    string           `json:"user_id"`
+	AcctId    string           `json:"acct_id"`
+	Address   string           `json:"address"`
+	Amount    *cointip.Balance `json:"amount"`
+	TxId      string           `json:"tx_id"`
+	Status    WithdrawalStatus `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func (w *Withdrawal) key() []byte {
+	return []byte(fmt.Sprintf("%s:%s", w.UserId, w.TxId))
+}
+
+type withdrawalStore interface {
+	Save(w *Withdrawal) error
+	ListPending() ([]*Withdrawal, error)
+	ListByUser(userId string) ([]*Withdrawal, error)
+}
+
+type boltWithdrawalStore struct {
+	db *bolt.DB
+}
+
+func openWithdrawalStore(db *bolt.DB) (withdrawalStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(withdrawalsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltWithdrawalStore{db: db}, nil
+}
+
+func (s *boltWithdrawalStore) Save(w *Withdrawal) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(withdrawalsBucket).Put(w.key(), buf)
+	})
+}
+
+func (s *boltWithdrawalStore) ListPending() ([]*Withdrawal, error) {
+	var pending []*Withdrawal
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(withdrawalsBucket).ForEach(func(k, v []byte) error {
+			w := &Withdrawal{}
+			if err := json.Unmarshal(v, w); err != nil {
+				return err
+			}
+			if !w.Status.terminal() {
+				pending = append(pending, w)
+			}
+			return nil
+		})
+	})
+	return pending, err
+}
+
+func (s *boltWithdrawalStore) ListByUser(userId string) ([]*Withdrawal, error) {
+	var withdrawals []*Withdrawal
+	prefix := []byte(fmt.Sprintf("%s:", userId))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(withdrawalsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			w := &Withdrawal{}
+			if err := json.Unmarshal(v, w); err != nil {
+				return err
+			}
+			withdrawals = append(withdrawals, w)
+		}
+		return nil
+	})
+	return withdrawals, err
+}
+
+// Light sanity checks on a destination address so we fail fast on an obvious typo
+// instead of burning a Coinbase API call.
+var (
+	btcAddressRe = regexp.MustCompile(`^(bc1|[13])[a-zA-HJ-NP-Z0-9]{25,39}$`)
+	ethAddressRe = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+)
+
+func validateAddress(address string) error {
+	if btcAddressRe.MatchString(address) || ethAddressRe.MatchString(address) {
+		return nil
+	}
+	return fmt.Errorf("%q doesn't look like a valid withdrawal address", address)
+}
+
+const withdrawalPollInterval = 30 * time.Second
+
+// pollWithdrawal polls Coinbase for the terminal status of a withdrawal, persisting
+// every observed status so a restart mid-poll can pick up exactly where this left off.
+func pollWithdrawal(ctx context.Context, w *Withdrawal) {
+	ticker := time.NewTicker(withdrawalPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tx, err := coinbaseClient.GetTransaction(w.AcctId, w.TxId)
+			if err != nil {
+				log.WithError(err).Errorf("Failed polling withdrawal %s for %s.", w.TxId, w.UserId)
+				continue
+			}
+
+			w.Status = WithdrawalStatus(tx.Status)
+			if err := withdrawals.Save(w); err != nil {
+				log.WithError(err).Error("Failed to persist withdrawal status.")
+			}
+
+			if w.Status.terminal() {
+				log.Infof("Withdrawal %s for %s reached terminal status: %s", w.TxId, w.UserId, w.Status)
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileWithdrawals re-polls every withdrawal that was still in flight when the
+// plugin last stopped, so a restart mid-send can't leak funds or strand a user
+// without a final status.
+func reconcileWithdrawals(ctx context.Context) {
+	pending, err := withdrawals.ListPending()
+	if err != nil {
+		log.WithError(err).Error("Failed to list pending withdrawals for reconciliation.")
+		return
+	}
+
+	for _, w := range pending {
+		log.Infof("Reconciling in-flight withdrawal %s for %s", w.TxId, w.UserId)
+		go pollWithdrawal(ctx, w)
+	}
+}
+
+func doWithdraw(cmdMsg *quadlek.CommandMsg, args []string) {
+	if len(args) != 2 {
+		say(cmdMsg, "usage: /cointip withdraw <address> <amount>", false)
+		return
+	}
+
+	address := args[0]
+	if err := validateAddress(address); err != nil {
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		sayError(cmdMsg, fmt.Sprintf("%q isn't a valid amount", args[1]), false)
+		return
+	}
+
+	account, err := getOrCreateAccount(cmdMsg.Command.UserId, cointip.CurrencyUSD)
+	if err != nil {
+		log.WithError(err).Error("Failed fetching coinbase account.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	tx, err := reserves.withReserve(account, amount, func() (*cointip.Transaction, error) {
+		return coinbaseClient.SendMoney(account.ID, address, &cointip.Balance{Currency: cointip.CurrencyUSD, Amount: amount})
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed sending withdrawal.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+
+	w := &Withdrawal{
+		UserId:    cmdMsg.Command.UserId,
+		AcctId:    account.ID,
+		Address:   address,
+		Amount:    &cointip.Balance{Currency: cointip.CurrencyUSD, Amount: amount},
+		TxId:      tx.ID,
+		Status:    WithdrawalStatus(tx.Status),
+		CreatedAt: time.Now(),
+	}
+	if err := withdrawals.Save(w); err != nil {
+		log.WithError(err).Error("Failed to persist withdrawal, continuing anyway.")
+	}
+
+	ledgerErr := dataStore.RecordLedger(&LedgerEntry{
+		Kind:         LedgerKindWithdrawal,
+		FromUser:     cmdMsg.Command.UserId,
+		CoinbaseTxId: tx.ID,
+		NativeAmount: w.Amount,
+		Status:       string(w.Status),
+		CreatedAt:    w.CreatedAt,
+	})
+	if ledgerErr != nil {
+		log.WithError(ledgerErr).Error("Failed to record withdrawal in ledger.")
+	}
+
+	go pollWithdrawal(pluginCtx, w)
+
+	say(cmdMsg, fmt.Sprintf("withdrawal of %.2f %s to %s submitted, txid: %s", amount, cointip.CurrencyUSD, address, tx.ID), false)
+}
+
+func doWithdrawals(cmdMsg *quadlek.CommandMsg) {
+	list, err := withdrawals.ListByUser(cmdMsg.Command.UserId)
+	if err != nil {
+		log.WithError(err).Error("Failed listing withdrawals.")
+		sayError(cmdMsg, err.Error(), false)
+		return
+	}
+	if len(list) == 0 {
+		say(cmdMsg, "you have no withdrawals on record", false)
+		return
+	}
+
+	lines := make([]string, 0, len(list))
+	for _, w := range list {
+		lines = append(lines, fmt.Sprintf("%s: %.2f %s -> %s [%s]", w.CreatedAt.Format(time.RFC822), w.Amount.Amount, w.Amount.Currency, w.Address, w.Status))
+	}
+	say(cmdMsg, strings.Join(lines, "\n"), false)
+}